@@ -1,20 +1,123 @@
 package config
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/Fornaxian/log"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
 )
 
+// watchDebounce is the duration Watch waits after the last filesystem event
+// before actually reloading the config, to coalesce editors which emit
+// several events for a single save (e.g. truncate+write, or rename+create).
+const watchDebounce = 200 * time.Millisecond
+
+// Format identifies the encoding used by a configuration file. It is used to
+// select the decoder which should be used to parse the file's contents.
+type Format string
+
+// The configuration file formats supported out of the box. Additional
+// formats can be added at runtime with Manager.RegisterDecoder.
+const (
+	// FormatAuto detects the format from the extension of the file being
+	// read. This is the default.
+	FormatAuto Format = ""
+	FormatTOML Format = "toml"
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+)
+
+// DecoderFunc decodes the raw contents of a configuration file into v. v will
+// always be a pointer of the same type as the conf parameter passed to New:
+// either Conf itself or a fresh copy (during a hot-reload or MergeAndSave).
+type DecoderFunc func(data []byte, v interface{}) error
+
+// EncoderFunc encodes v into the raw contents of a configuration file. v will
+// always be the current Conf, a pointer of the same type as the conf parameter
+// passed to New (not necessarily the same pointer, as Watch and MergeAndSave
+// replace Conf with a fresh copy).
+type EncoderFunc func(v interface{}) ([]byte, error)
+
 // Manager is in charge of finding and reading configuration files
 type Manager struct {
-	confPaths     []string
-	fileName      string
-	defaultConfig string
-	Conf          interface{}
+	confPaths      []string
+	fileName       string
+	defaultConfig  string
+	format         Format
+	decoders       map[string]DecoderFunc
+	encoders       map[string]EncoderFunc
+	strictDecoders map[string]DecoderFunc
+	loadedPath     string
+
+	// mu guards Conf against the data race between Watch's background
+	// reload goroutine and any other goroutine reading Conf. It's only
+	// taken internally, around the calls that decode into or reassign
+	// Conf; it does not protect direct reads of the Conf field from other
+	// goroutines. Callers which use Watch for hot-reload from more than one
+	// goroutine should read the config through Config() instead of the Conf
+	// field directly.
+	mu sync.RWMutex
+
+	// Conf holds the decoded configuration. It is safe to read directly
+	// from a single goroutine, or from multiple goroutines as long as Watch
+	// is never used concurrently with those reads. Once Watch is running in
+	// the background, use Config() for a race-free read instead.
+	Conf interface{}
+
+	// Layered enables layered config loading. When true, LoadConfig decodes
+	// every readable file in confPaths instead of stopping at the first one,
+	// applying them in reverse priority order so a high priority file only
+	// needs to specify the keys it wants to override, e.g. a package default
+	// in /usr/local/etc overridden by selected keys in ~/.config. Keys which
+	// are omitted from every file keep the value set by defaultConfig.
+	Layered bool
+
+	// EnvPrefix, when set, enables overlaying environment variables on top
+	// of Conf after every successful LoadConfig. A field is matched by
+	// joining its path from the root with underscores, upper-cased, and
+	// prefixed with EnvPrefix, e.g. with EnvPrefix "APP" the field
+	// Conf.Database.Host is overlaid by the APP_DATABASE_HOST environment
+	// variable. Field names are taken from the struct tag matching the
+	// Manager's format (toml, yaml or json) when present, falling back to
+	// the Go field name.
+	EnvPrefix string
+
+	// EnableEnvExpansion, when true, expands ${VAR} and $VAR placeholders in
+	// every string field of Conf using os.ExpandEnv after every successful
+	// LoadConfig. This lets a single config file be reused across
+	// environments by referencing environment variables in string values.
+	EnableEnvExpansion bool
+
+	// Strict, when true, makes decoding a TOML config file fail when it
+	// contains keys which aren't present in Conf's struct, instead of
+	// silently ignoring them. Such a file is handled like any other file
+	// which fails to decode: a warning is logged and the file is skipped.
+	// LoadConfig/LoadLayered then carry on with the remaining confPaths
+	// entries, and return an error (ErrNoConfigFound) only when no other
+	// file can be loaded.
+	Strict bool
+}
+
+// Validator can optionally be implemented by the struct passed to New as the
+// conf parameter. If Conf implements it, Validate is called after every
+// successful LoadConfig/LoadLayered decode, so applications can reject
+// semantically-invalid combinations of values (e.g. mutually exclusive
+// options both being set) before the program continues.
+type Validator interface {
+	Validate() error
 }
 
 // ErrNoConfigFound returned by ReloadConfig if no config file cound be found
@@ -25,7 +128,7 @@ func (ErrNoConfigFound) Error() string {
 }
 
 // New prepares a new configuration manager which can be used to read properties
-// from a TOML config file. The confDir param can be used to set a custom config
+// from a config file. The confDir param can be used to set a custom config
 // directory. If it's left empty the default config locations will be used. When
 // no config files can be found on the system a new one will be generated in the
 // current working directory, and the program will exit. If it fails to write
@@ -33,8 +136,10 @@ func (ErrNoConfigFound) Error() string {
 // config file and exit with an error status.
 //
 // Params:
-// - defaultConfig: The default configuration file in TOML format. If a config
-//                  file is found at any of the configured locations, but it's
+// - defaultConfig: The default configuration file, encoded in the format
+//                  selected by the format param (or detected from fileName's
+//                  extension when format is FormatAuto). If a config file is
+//                  found at any of the configured locations, but it's
 //                  missing some tags the default values from this config will
 //                  be used. Note that if no config files are found, all the
 //                  properties will be the defaults.
@@ -42,8 +147,14 @@ func (ErrNoConfigFound) Error() string {
 //                  If empty the default system directories will be searched for
 //                  configuration files.
 // - fileName:      The name of the configuration file, only files with this
-//                  name will be attempted to be parsed.
-// - conf:          This has to be a pointer to a struct with TOML annotations.
+//                  name will be attempted to be parsed. Its extension is used
+//                  to auto-detect the config format when format is FormatAuto.
+// - format:        The format of the configuration file. Set to FormatAuto to
+//                  detect it from fileName's extension, or pick one of the
+//                  other Format constants to force it. Use RegisterDecoder to
+//                  add support for formats which aren't built in.
+// - conf:          This has to be a pointer to a struct with tags matching
+//                  the selected format, e.g. TOML tags for FormatTOML.
 //                  https://github.com/BurntSushi/toml/blob/master/README.md#examples
 // - autoload:      Setting this to true will automatically load the config file
 //                  before returning this function. If it fails to load the
@@ -53,6 +164,7 @@ func (ErrNoConfigFound) Error() string {
 //                  Manager.LoadConfig manually.
 func New(
 	defaultConf, confDir, fileName string,
+	format Format,
 	config interface{},
 	autoload bool,
 ) (*Manager, error) {
@@ -67,13 +179,28 @@ func New(
 		},
 		fileName:      fileName,
 		defaultConfig: defaultConf,
-		Conf:          config,
+		format:        format,
+		decoders: map[string]DecoderFunc{
+			string(FormatTOML): tomlDecode,
+			string(FormatYAML): yamlDecode,
+			"yml":              yamlDecode,
+			string(FormatJSON): jsonDecode,
+		},
+		strictDecoders: map[string]DecoderFunc{
+			string(FormatTOML): strictTOMLDecode,
+		},
+		encoders: map[string]EncoderFunc{
+			string(FormatTOML): tomlEncode,
+			string(FormatYAML): yamlEncode,
+			"yml":              yamlEncode,
+			string(FormatJSON): jsonEncode,
+		},
+		Conf: config,
 	}
 
 	// Read the default configuration. The values entered in the config file
 	// will overwrite the defaults
-	_, err = toml.Decode(defaultConf, c.Conf)
-	if err != nil {
+	if err = c.applyDefaults(c.Conf); err != nil {
 		return nil, fmt.Errorf("failed to decode default config: %s", err)
 	}
 
@@ -105,12 +232,125 @@ func New(
 	return c, nil
 }
 
-// LoadConfig tries every configuration file configured in the Manager until it
-// finds one it can read. If no configuration files can be read it will return
-// an ErrNoConfigFound error. If error is nil the config was loaded
-// successfully. This function can be called multiple times to reload the config
-// file from disk.
+// RegisterDecoder registers a decoder for files with the given extension
+// (without the leading dot, e.g. "hcl" or "env"). This allows applications to
+// add support for config formats which aren't built in, such as HCL or
+// envfiles. Registering a decoder for an extension which already has one
+// (toml, yaml/yml or json) overrides the built-in decoder.
+//
+// Overriding the "toml" extension also disables Manager.Strict for that
+// extension: strict mode's unknown-key check relies on the metadata the
+// built-in TOML decoder produces, which a replacement decoder isn't
+// guaranteed to supply, so LoadConfig falls back to plain decoding with fn
+// rather than silently ignoring fn and enforcing strictness anyway.
+func (c *Manager) RegisterDecoder(ext string, fn DecoderFunc) {
+	ext = strings.ToLower(ext)
+	c.decoders[ext] = fn
+	delete(c.strictDecoders, ext)
+}
+
+// RegisterEncoder registers an encoder for files with the given extension
+// (without the leading dot, e.g. "hcl" or "env"), used by SaveConfig to
+// marshal Conf back to disk. Registering an encoder for an extension which
+// already has one (toml, yaml/yml or json) overrides the built-in encoder.
+func (c *Manager) RegisterEncoder(ext string, fn EncoderFunc) {
+	c.encoders[strings.ToLower(ext)] = fn
+}
+
+// decoderFor returns the decoder which should be used for the given file
+// path, based on the Manager's configured format, falling back to the file's
+// extension when the format is FormatAuto.
+func (c *Manager) decoderFor(path string) (DecoderFunc, error) {
+	format := c.format
+	if format == FormatAuto {
+		format = Format(strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."))
+	}
+	if format == "" {
+		return nil, fmt.Errorf("unable to determine config format for '%s', "+
+			"set Format explicitly or give the file a recognized extension", path)
+	}
+
+	if c.Strict {
+		if strict, ok := c.strictDecoders[string(format)]; ok {
+			return strict, nil
+		}
+	}
+
+	decode, ok := c.decoders[string(format)]
+	if !ok {
+		return nil, fmt.Errorf("no decoder registered for format '%s'", format)
+	}
+	return decode, nil
+}
+
+// strictTOMLDecode is like tomlDecode, but fails if the file contains any
+// keys which aren't present in v's struct, using toml.MetaData.Undecoded().
+// It's used instead of tomlDecode when Manager.Strict is enabled.
+func strictTOMLDecode(data []byte, v interface{}) error {
+	meta, err := toml.Decode(string(data), v)
+	if err != nil {
+		return err
+	}
+
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, k := range undecoded {
+			keys[i] = k.String()
+		}
+		return fmt.Errorf("unknown configuration key(s): %s", strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// encoderFor returns the encoder which should be used for the given file
+// path, based on the Manager's configured format, falling back to the file's
+// extension when the format is FormatAuto.
+func (c *Manager) encoderFor(path string) (EncoderFunc, error) {
+	format := c.format
+	if format == FormatAuto {
+		format = Format(strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."))
+	}
+	if format == "" {
+		return nil, fmt.Errorf("unable to determine config format for '%s', "+
+			"set Format explicitly or give the file a recognized extension", path)
+	}
+
+	encode, ok := c.encoders[string(format)]
+	if !ok {
+		return nil, fmt.Errorf("no encoder registered for format '%s'", format)
+	}
+	return encode, nil
+}
+
+// Config returns the current configuration value. Unlike reading the Conf
+// field directly, this is safe to call concurrently with Watch's background
+// reload goroutine.
+func (c *Manager) Config() interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Conf
+}
+
+// LoadConfig loads the configuration from disk into Conf. If Layered is true
+// this delegates to LoadLayered, otherwise it tries every configuration file
+// configured in the Manager until it finds one it can read, and stops there.
+// If no configuration files can be read it will return an ErrNoConfigFound
+// error. If error is nil the config was loaded successfully. This function
+// can be called multiple times to reload the config file from disk.
 func (c *Manager) LoadConfig() error {
+	if c.Layered {
+		return c.LoadLayered()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loadSingleInto(c.Conf, true)
+}
+
+// loadSingleInto tries every configuration file configured in the Manager
+// until it finds one it can decode into target, and stops there. If
+// trackPath is true the path it loaded is recorded in c.loadedPath, for use
+// by Watch/MergeAndSave.
+func (c *Manager) loadSingleInto(target interface{}, trackPath bool) error {
 	var confStr []byte
 	var err error
 
@@ -127,15 +367,526 @@ func (c *Manager) LoadConfig() error {
 		}
 		// Reading succeeded, now try decoding
 
-		_, err = toml.Decode(string(confStr), c.Conf)
+		decode, err := c.decoderFor(cd)
 		if err != nil {
 			log.Warn("Unable to decode config file at '%s': %s", cd, err)
 			continue
 		}
 
+		if err = decode(confStr, target); err != nil {
+			log.Warn("Unable to decode config file at '%s': %s", cd, err)
+			continue
+		}
+
 		// We did it
-		return nil
+		if trackPath {
+			c.loadedPath = cd
+		}
+		return c.postProcess(target)
 	}
 
 	return ErrNoConfigFound{}
 }
+
+// LoadLayered decodes every readable configuration file in confPaths, in
+// reverse priority order, so that a higher priority file only needs to
+// specify the keys it wants to override; any key it omits keeps the value
+// decoded from a lower priority file (or the default config). Returns
+// ErrNoConfigFound if none of the configured paths could be read.
+func (c *Manager) LoadLayered() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loadLayeredInto(c.Conf, true)
+}
+
+// loadLayeredInto is the target-parameterized implementation of LoadLayered,
+// also used by the hot-reload path in reloadWatched to replay every layer
+// into a freshly allocated Conf. If trackPath is true the highest priority
+// path found is recorded in c.loadedPath, for use by Watch/MergeAndSave.
+func (c *Manager) loadLayeredInto(target interface{}, trackPath bool) error {
+	var found bool
+
+	for i := len(c.confPaths) - 1; i >= 0; i-- {
+		cd := c.confPaths[i]
+		if cd == "" {
+			continue
+		}
+
+		log.Debug("Trying configuration file '%s'", cd)
+		confStr, err := ioutil.ReadFile(cd)
+		if err != nil {
+			log.Debug("No config found at '%s' (%s)", cd, err)
+			continue
+		}
+
+		decode, err := c.decoderFor(cd)
+		if err != nil {
+			log.Warn("Unable to decode config file at '%s': %s", cd, err)
+			continue
+		}
+
+		if err = decode(confStr, target); err != nil {
+			log.Warn("Unable to decode config file at '%s': %s", cd, err)
+			continue
+		}
+
+		if trackPath {
+			c.loadedPath = cd
+		}
+		found = true
+	}
+
+	if !found {
+		return ErrNoConfigFound{}
+	}
+	return c.postProcess(target)
+}
+
+// Watch watches whichever confPaths entry was actually loaded by the last
+// call to LoadConfig/LoadLayered (and its containing directory, to also
+// catch editors which save by renaming a temp file over the original) and
+// reloads the config whenever it changes. Events are debounced by
+// watchDebounce to coalesce the several filesystem events a single save can
+// produce. On every successful reload onReload is called with the previous
+// and new Conf snapshots so the caller can diff them and re-wire any
+// subsystems that depend on changed values. If the new file fails to decode
+// the previous Conf is retained, an error is logged, and onReload is not
+// called. Watch blocks until ctx is cancelled, at which point it returns
+// ctx.Err().
+//
+// Watch reassigns Conf from its own goroutine on every reload. Other
+// goroutines must read the config through Config(), not the Conf field
+// directly, once Watch is running concurrently with them.
+func (c *Manager) Watch(ctx context.Context, onReload func(old, new interface{}) error) error {
+	if c.loadedPath == "" {
+		return fmt.Errorf("no config file has been loaded yet, call LoadConfig first")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %s", err)
+	}
+	defer watcher.Close()
+
+	dir := filepath.Dir(c.loadedPath)
+	if err = watcher.Add(dir); err != nil {
+		return fmt.Errorf("failed to watch '%s': %s", dir, err)
+	}
+
+	var debounce *time.Timer
+	reload := make(chan struct{}, 1)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("file watcher closed unexpectedly")
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(c.loadedPath) {
+				continue
+			}
+
+			trigger := func() {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			}
+			if debounce == nil {
+				debounce = time.AfterFunc(watchDebounce, trigger)
+			} else {
+				debounce.Reset(watchDebounce)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("file watcher closed unexpectedly")
+			}
+			log.Warn("Config file watcher error: %s", err)
+
+		case <-reload:
+			if err := c.reloadWatched(onReload); err != nil {
+				log.Warn("Failed to reload config: %s", err)
+			}
+		}
+	}
+}
+
+// reloadWatched replays the full load sequence - defaultConfig, followed by
+// every confPaths entry LoadConfig/LoadLayered would read (single file or
+// all layers, depending on c.Layered) - into a fresh copy of Conf's type,
+// and on success swaps it in and invokes onReload with the old and new
+// snapshots. Replaying the whole sequence, rather than just re-decoding the
+// single file fsnotify reported a change for, matters because a fresh copy
+// starts at the Go zero value: any field the watched file (or, in Layered
+// mode, a lower priority layer) doesn't set needs defaultConfig or that
+// lower layer decoded into it again, or it would reset to zero on every
+// reload. On failure the previous Conf is retained and an error is
+// returned; onReload is not called.
+func (c *Manager) reloadWatched(onReload func(old, new interface{}) error) error {
+	c.mu.RLock()
+	old := c.Conf
+	fresh := reflect.New(reflect.TypeOf(old).Elem()).Interface()
+	c.mu.RUnlock()
+
+	// Decode the watched file on its own first: the load sequence below skips
+	// a file which fails to decode and uses the other confPaths entries, which
+	// would replace Conf instead of keeping the previous one.
+	data, err := ioutil.ReadFile(c.loadedPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file '%s', keeping previous config: %s", c.loadedPath, err)
+	}
+	decode, err := c.decoderFor(c.loadedPath)
+	if err != nil {
+		return fmt.Errorf("failed to reload config, keeping previous config: %s", err)
+	}
+	if err = decode(data, reflect.New(reflect.TypeOf(old).Elem()).Interface()); err != nil {
+		return fmt.Errorf("failed to decode config file '%s', keeping previous config: %s", c.loadedPath, err)
+	}
+
+	if err := c.applyDefaults(fresh); err != nil {
+		return fmt.Errorf("failed to decode default config: %s", err)
+	}
+
+	if c.Layered {
+		err = c.loadLayeredInto(fresh, false)
+	} else {
+		err = c.loadSingleInto(fresh, false)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reload config, keeping previous config: %s", err)
+	}
+
+	c.mu.Lock()
+	c.Conf = fresh
+	c.mu.Unlock()
+
+	log.Info("Reloaded configuration file '%s'", c.loadedPath)
+	if onReload != nil {
+		if err = onReload(old, fresh); err != nil {
+			return fmt.Errorf("onReload callback returned error: %s", err)
+		}
+	}
+	return nil
+}
+
+// applyDefaults decodes defaultConfig into target, the same way New does for
+// the initial Conf.
+func (c *Manager) applyDefaults(target interface{}) error {
+	decode, err := c.decoderFor(c.fileName)
+	if err != nil {
+		return err
+	}
+	return decode([]byte(c.defaultConfig), target)
+}
+
+// postProcess runs the post-decode steps which apply to every successful
+// LoadConfig/LoadLayered call: the environment variable overlay, ${VAR}
+// expansion, and Validator invocation. It operates on target rather than
+// always on c.Conf so it can also be used to process a fresh copy of Conf's
+// type during a hot-reload, before that copy is swapped in.
+func (c *Manager) postProcess(target interface{}) error {
+	if c.EnvPrefix != "" {
+		if err := c.overlayEnv(target, c.EnvPrefix); err != nil {
+			return fmt.Errorf("failed to overlay environment variables: %s", err)
+		}
+	}
+
+	if c.EnableEnvExpansion {
+		expandEnvStrings(reflect.ValueOf(target))
+	}
+
+	if v, ok := target.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("config validation failed: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// overlayEnv walks v (a pointer to struct) recursively and overlays any
+// matching environment variables on top of the already-decoded values.
+func (c *Manager) overlayEnv(v interface{}, prefix string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("overlayEnv: v must be a pointer to a struct")
+	}
+	return c.overlayStruct(rv.Elem(), prefix)
+}
+
+func (c *Manager) overlayStruct(rv reflect.Value, prefix string) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.PkgPath != "" { // Unexported field
+			continue
+		}
+
+		fv := rv.Field(i)
+		envKey := prefix + "_" + c.fieldEnvName(field)
+
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+
+		if fv.Kind() == reflect.Struct {
+			if err := c.overlayStruct(fv, envKey); err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok := os.LookupEnv(envKey)
+		if !ok {
+			continue
+		}
+
+		if err := setFieldFromString(fv, raw); err != nil {
+			return fmt.Errorf("failed to apply %s to %s: %s", envKey, field.Name, err)
+		}
+	}
+	return nil
+}
+
+// fieldEnvName returns the name used to build the environment variable for
+// field, taken from the struct tag matching the Manager's format (toml, yaml
+// or json) when present, falling back to the Go field name.
+func (c *Manager) fieldEnvName(field reflect.StructField) string {
+	tagKey := string(c.format)
+	if tagKey == "" {
+		tagKey = "toml"
+	}
+
+	if tag, ok := field.Tag.Lookup(tagKey); ok {
+		name := strings.Split(tag, ",")[0]
+		if name != "" && name != "-" {
+			return strings.ToUpper(name)
+		}
+	}
+
+	return strings.ToUpper(field.Name)
+}
+
+// setFieldFromString assigns raw to fv, converting it according to fv's kind
+func setFieldFromString(fv reflect.Value, raw string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Kind())
+	}
+	return nil
+}
+
+// expandEnvStrings walks rv recursively and expands ${VAR}/$VAR placeholders
+// in every settable string field using os.ExpandEnv.
+func expandEnvStrings(rv reflect.Value) {
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if !rv.IsNil() {
+			expandEnvStrings(rv.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < rv.NumField(); i++ {
+			if rv.Type().Field(i).PkgPath != "" { // Unexported field
+				continue
+			}
+			expandEnvStrings(rv.Field(i))
+		}
+	case reflect.String:
+		if rv.CanSet() {
+			rv.SetString(os.ExpandEnv(rv.String()))
+		}
+	}
+}
+
+// tomlDecode is the built-in DecoderFunc for FormatTOML
+func tomlDecode(data []byte, v interface{}) error {
+	_, err := toml.Decode(string(data), v)
+	return err
+}
+
+// yamlDecode is the built-in DecoderFunc for FormatYAML
+func yamlDecode(data []byte, v interface{}) error {
+	return yaml.Unmarshal(data, v)
+}
+
+// jsonDecode is the built-in DecoderFunc for FormatJSON
+func jsonDecode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// tomlEncode is the built-in EncoderFunc for FormatTOML
+func tomlEncode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// yamlEncode is the built-in EncoderFunc for FormatYAML
+func yamlEncode(v interface{}) ([]byte, error) {
+	return yaml.Marshal(v)
+}
+
+// jsonEncode is the built-in EncoderFunc for FormatJSON
+func jsonEncode(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// SaveConfig marshals the current Conf back into the format matching path's
+// extension (or the Manager's configured Format, if it's not FormatAuto) and
+// writes it to path atomically: the data is written to a temporary file in
+// the same directory and then renamed into place, so readers never observe a
+// partially written file.
+func (c *Manager) SaveConfig(path string) error {
+	encode, err := c.encoderFor(path)
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	data, err := encode(c.Conf)
+	c.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %s", err)
+	}
+
+	return atomicWriteFile(path, data, 0644)
+}
+
+// WriteDefault writes the unmodified default configuration given to New to
+// path. This is useful to let users start from a fresh copy of the built-in
+// defaults, e.g. from a "generate-config" subcommand.
+func (c *Manager) WriteDefault(path string) error {
+	return atomicWriteFile(path, []byte(c.defaultConfig), 0644)
+}
+
+// MergeAndSave re-reads the on-disk config file at the path last loaded by
+// LoadConfig/LoadLayered into a fresh copy of Conf's type, overlays onto
+// that copy every field which holds a non-zero value on the current
+// in-memory Conf, and writes the merged result back to disk with
+// SaveConfig. If no config file has been loaded yet this falls back to
+// saving Conf directly to fileName.
+//
+// The overlaid fields are not limited to those the application changed at
+// runtime (such as tokens or generated IDs): any non-zero value Conf got
+// from defaultConfig, from another layer in Layered mode, from EnvPrefix or
+// from ${VAR} expansion is written to the file as well.
+//
+// Note that this always collapses the file to exactly Conf's known fields:
+// the file is decoded into a typed struct and re-encoded from it, so any key
+// present on disk that Conf's type doesn't have a field for - whether added
+// by hand or by a lower-priority layer in Layered mode - is dropped, and any
+// comments in the original file are lost. SaveConfig drops them as well, as
+// it also encodes Conf.
+func (c *Manager) MergeAndSave() error {
+	if c.loadedPath == "" {
+		return c.SaveConfig(c.fileName)
+	}
+
+	onDisk, err := ioutil.ReadFile(c.loadedPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file '%s': %s", c.loadedPath, err)
+	}
+
+	decode, err := c.decoderFor(c.loadedPath)
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	confType := reflect.TypeOf(c.Conf)
+	c.mu.RUnlock()
+
+	merged := reflect.New(confType.Elem()).Interface()
+	if err = decode(onDisk, merged); err != nil {
+		return fmt.Errorf("failed to decode config file '%s': %s", c.loadedPath, err)
+	}
+
+	c.mu.Lock()
+	mergeNonZero(reflect.ValueOf(merged).Elem(), reflect.ValueOf(c.Conf).Elem())
+	c.Conf = merged
+	c.mu.Unlock()
+
+	return c.SaveConfig(c.loadedPath)
+}
+
+// mergeNonZero copies every field from src into dst where the src field
+// does not hold its zero value, recursing into nested structs so that only
+// the leaves which were actually changed get overridden.
+func mergeNonZero(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).PkgPath != "" { // Unexported field
+			continue
+		}
+
+		sf, df := src.Field(i), dst.Field(i)
+		if sf.Kind() == reflect.Struct {
+			mergeNonZero(df, sf)
+			continue
+		}
+		if !sf.IsZero() {
+			df.Set(sf)
+		}
+	}
+}
+
+// atomicWriteFile writes data to path by first writing it to a temporary
+// file in the same directory and then renaming it into place, so that
+// readers never observe a partially written file.
+func atomicWriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file in '%s': %s", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %s", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %s", err)
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("failed to set permissions on temp file: %s", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename temp file into place: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,400 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testSubConfig struct {
+	Name string `toml:"name"`
+}
+
+type testConfig struct {
+	Host string        `toml:"host"`
+	Port int           `toml:"port"`
+	Sub  testSubConfig `toml:"sub"`
+}
+
+const testDefaultConfig = `
+host = "localhost"
+port = 8080
+
+[sub]
+name = "default-name"
+`
+
+// newTestManager builds a Manager around testConfig with confPaths replaced
+// by two deterministic fixture paths in a temp dir, so tests don't depend on
+// $HOME or /etc. override is the higher priority path (confPaths[0]), base
+// the lower priority one, matching the precedence LoadLayered documents.
+func newTestManager(t *testing.T, layered bool) (m *Manager, base, override string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	base = filepath.Join(dir, "base.toml")
+	override = filepath.Join(dir, "override.toml")
+
+	m, err := New(testDefaultConfig, "", "app.toml", FormatTOML, &testConfig{}, false)
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+	m.Layered = layered
+	m.confPaths = []string{override, base}
+	return m, base, override
+}
+
+func TestLoadLayered(t *testing.T) {
+	m, base, override := newTestManager(t, true)
+
+	if err := os.WriteFile(base, []byte(`host = "base-host"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(override, []byte(`port = 9090`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadLayered(); err != nil {
+		t.Fatalf("LoadLayered() error: %s", err)
+	}
+
+	conf := m.Conf.(*testConfig)
+	if conf.Host != "base-host" {
+		t.Errorf("Host = %q, want %q (from the base layer)", conf.Host, "base-host")
+	}
+	if conf.Port != 9090 {
+		t.Errorf("Port = %d, want %d (from the override layer)", conf.Port, 9090)
+	}
+	if conf.Sub.Name != "default-name" {
+		t.Errorf("Sub.Name = %q, want %q (from defaultConfig)", conf.Sub.Name, "default-name")
+	}
+}
+
+func TestEnvOverlayAndExpansion(t *testing.T) {
+	m, base, _ := newTestManager(t, false)
+	m.confPaths = []string{base}
+	m.EnvPrefix = "TESTAPP"
+	m.EnableEnvExpansion = true
+
+	if err := os.WriteFile(base, []byte(`host = "${TESTAPP_HOSTNAME}"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("TESTAPP_HOSTNAME", "expanded-host")
+	defer os.Unsetenv("TESTAPP_HOSTNAME")
+	os.Setenv("TESTAPP_PORT", "1234")
+	defer os.Unsetenv("TESTAPP_PORT")
+
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error: %s", err)
+	}
+
+	conf := m.Conf.(*testConfig)
+	if conf.Host != "expanded-host" {
+		t.Errorf("Host = %q, want %q (${VAR} expanded)", conf.Host, "expanded-host")
+	}
+	if conf.Port != 1234 {
+		t.Errorf("Port = %d, want %d (overlaid from TESTAPP_PORT)", conf.Port, 1234)
+	}
+}
+
+// TestReloadPreservesDefaultsAndLayers is a regression test for a bug where
+// a Watch-triggered reload decoded only the changed file into a zero-valued
+// copy of Conf, resetting every field the file didn't set - including
+// defaultConfig's values and any lower-priority layer - to its Go zero
+// value.
+func TestReloadPreservesDefaultsAndLayers(t *testing.T) {
+	m, base, override := newTestManager(t, true)
+
+	if err := os.WriteFile(base, []byte(`host = "base-host"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(override, []byte(`port = 9090`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadLayered(); err != nil {
+		t.Fatalf("LoadLayered() error: %s", err)
+	}
+
+	// Only the top layer changes, as fsnotify would report for an edit to
+	// the watched file.
+	if err := os.WriteFile(override, []byte(`port = 9191`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.reloadWatched(nil); err != nil {
+		t.Fatalf("reloadWatched() error: %s", err)
+	}
+
+	conf := m.Conf.(*testConfig)
+	if conf.Host != "base-host" {
+		t.Errorf("Host = %q after reload, want %q (base layer must survive a reload of the override file)", conf.Host, "base-host")
+	}
+	if conf.Sub.Name != "default-name" {
+		t.Errorf("Sub.Name = %q after reload, want %q (defaultConfig must survive reload)", conf.Sub.Name, "default-name")
+	}
+	if conf.Port != 9191 {
+		t.Errorf("Port = %d after reload, want %d (from the reloaded override layer)", conf.Port, 9191)
+	}
+}
+
+// TestConfigConcurrentAccess exercises Config() against concurrent
+// reloadWatched calls under `go test -race` as a regression test for a data
+// race between Watch's reload goroutine and readers of Conf.
+func TestConfigConcurrentAccess(t *testing.T) {
+	m, base, _ := newTestManager(t, false)
+	m.confPaths = []string{base}
+
+	if err := os.WriteFile(base, []byte(`port = 1`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error: %s", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = m.Config()
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		if err := m.reloadWatched(nil); err != nil {
+			t.Fatalf("reloadWatched() error: %s", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestLoadConfigAutoDetectsFormatFromExtension covers the multi-format
+// decoding path: with Format left at FormatAuto, LoadConfig should pick the
+// decoder matching each confPaths entry's own extension, independent of the
+// fileName/format given to New (used only for defaultConfig).
+func TestLoadConfigAutoDetectsFormatFromExtension(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "app.yaml")
+	jsonPath := filepath.Join(dir, "app.json")
+
+	if err := os.WriteFile(yamlPath, []byte("host: yaml-host\nport: 4242\nsub:\n  name: yaml-name\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jsonPath, []byte(`{"host": "json-host", "port": 4343, "sub": {"name": "json-name"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(testDefaultConfig, "", "app.toml", FormatAuto, &testConfig{}, false)
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+
+	m.confPaths = []string{yamlPath}
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() of a .yaml file error: %s", err)
+	}
+	if conf := m.Conf.(*testConfig); conf.Host != "yaml-host" || conf.Port != 4242 || conf.Sub.Name != "yaml-name" {
+		t.Errorf("decoded YAML config = %+v, want {yaml-host 4242 {yaml-name}}", conf)
+	}
+
+	m.Conf = &testConfig{}
+	m.confPaths = []string{jsonPath}
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() of a .json file error: %s", err)
+	}
+	if conf := m.Conf.(*testConfig); conf.Host != "json-host" || conf.Port != 4343 || conf.Sub.Name != "json-name" {
+		t.Errorf("decoded JSON config = %+v, want {json-host 4343 {json-name}}", conf)
+	}
+}
+
+// TestRegisterDecoderOverridesBuiltin confirms a decoder registered with
+// RegisterDecoder is actually used by LoadConfig instead of the built-in one
+// for that extension.
+func TestRegisterDecoderOverridesBuiltin(t *testing.T) {
+	m, base, _ := newTestManager(t, false)
+	m.confPaths = []string{base}
+
+	var called bool
+	m.RegisterDecoder("toml", func(data []byte, v interface{}) error {
+		called = true
+		v.(*testConfig).Host = "custom-decoder-host"
+		return nil
+	})
+
+	if err := os.WriteFile(base, []byte(`host = "base-host"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error: %s", err)
+	}
+
+	if !called {
+		t.Fatal("registered decoder was never invoked")
+	}
+	if conf := m.Conf.(*testConfig); conf.Host != "custom-decoder-host" {
+		t.Errorf("Host = %q, want %q (set by the registered decoder)", conf.Host, "custom-decoder-host")
+	}
+}
+
+// TestStrictRejectsUnknownKeys confirms that with Strict enabled, a TOML file
+// containing a key the target struct doesn't declare fails to load.
+func TestStrictRejectsUnknownKeys(t *testing.T) {
+	m, base, _ := newTestManager(t, false)
+	m.confPaths = []string{base}
+	m.Strict = true
+
+	if err := os.WriteFile(base, []byte("host = \"base-host\"\nnosuchfield = \"x\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadConfig(); err == nil {
+		t.Fatal("LoadConfig() with Strict = true and an unknown key, want an error, got nil")
+	}
+}
+
+// TestRegisterDecoderBypassesStrict is a regression test for a bug where
+// decoderFor always used strictTOMLDecode whenever Strict was set, silently
+// ignoring a decoder registered with RegisterDecoder. Registering a "toml"
+// decoder should disable the strict unknown-key check for that extension, as
+// RegisterDecoder now documents.
+func TestRegisterDecoderBypassesStrict(t *testing.T) {
+	m, base, _ := newTestManager(t, false)
+	m.confPaths = []string{base}
+	m.Strict = true
+
+	var called bool
+	m.RegisterDecoder("toml", func(data []byte, v interface{}) error {
+		called = true
+		return tomlDecode(data, v)
+	})
+
+	if err := os.WriteFile(base, []byte("host = \"base-host\"\nnosuchfield = \"x\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error: %s, want nil because RegisterDecoder(\"toml\", ...) disables strict checking for toml", err)
+	}
+	if !called {
+		t.Errorf("registered decoder was never invoked")
+	}
+}
+
+type validatingConfig struct {
+	Host string `toml:"host"`
+	Port int    `toml:"port"`
+}
+
+func (c *validatingConfig) Validate() error {
+	if c.Port <= 0 {
+		return fmt.Errorf("port must be positive, got %d", c.Port)
+	}
+	return nil
+}
+
+// TestValidatorHookRuns confirms postProcess invokes Validate() on a config
+// struct implementing the Validator interface, and surfaces its error.
+func TestValidatorHookRuns(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.toml")
+
+	m, err := New(`host = "localhost"
+port = 1
+`, "", "app.toml", FormatTOML, &validatingConfig{}, false)
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+	m.confPaths = []string{path}
+
+	if err := os.WriteFile(path, []byte(`port = -1`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadConfig(); err == nil {
+		t.Fatal("LoadConfig() with an invalid Port, want a Validate() error, got nil")
+	}
+
+	if err := os.WriteFile(path, []byte(`port = 80`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() with a valid Port, want nil, got: %s", err)
+	}
+}
+
+// TestSaveConfigRoundTrip confirms a mutated Conf, once written with
+// SaveConfig, decodes back to the same values.
+func TestSaveConfigRoundTrip(t *testing.T) {
+	m, base, _ := newTestManager(t, false)
+	m.confPaths = []string{base}
+
+	if err := os.WriteFile(base, []byte(`host = "base-host"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error: %s", err)
+	}
+	m.Conf.(*testConfig).Port = 5555
+
+	savePath := filepath.Join(t.TempDir(), "saved.toml")
+	if err := m.SaveConfig(savePath); err != nil {
+		t.Fatalf("SaveConfig() error: %s", err)
+	}
+
+	m.Conf = &testConfig{}
+	m.confPaths = []string{savePath}
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() of the saved file error: %s", err)
+	}
+
+	reloaded := m.Conf.(*testConfig)
+	if reloaded.Host != "base-host" || reloaded.Port != 5555 || reloaded.Sub.Name != "default-name" {
+		t.Errorf("reloaded saved config = %+v, want {base-host 5555 {default-name}}", reloaded)
+	}
+}
+
+// TestMergeAndSaveDropsUnknownKeys is a regression test for MergeAndSave's
+// doc comment, which used to incorrectly claim unknown on-disk keys are
+// preserved. MergeAndSave decodes the on-disk file into a typed copy of Conf,
+// so a key the struct doesn't declare is dropped once the merged result is
+// re-encoded.
+func TestMergeAndSaveDropsUnknownKeys(t *testing.T) {
+	m, base, _ := newTestManager(t, false)
+	m.confPaths = []string{base}
+
+	if err := os.WriteFile(base, []byte("host = \"base-host\"\nunknown_field = \"x\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error: %s", err)
+	}
+	m.Conf.(*testConfig).Port = 7777
+
+	if err := m.MergeAndSave(); err != nil {
+		t.Fatalf("MergeAndSave() error: %s", err)
+	}
+
+	raw, err := os.ReadFile(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "unknown_field") {
+		t.Errorf("MergeAndSave() kept unknown_field in the saved file, want it dropped: %s", raw)
+	}
+
+	conf := m.Conf.(*testConfig)
+	if conf.Host != "base-host" || conf.Port != 7777 {
+		t.Errorf("merged Conf = %+v, want Host %q and Port %d preserved", conf, "base-host", 7777)
+	}
+}